@@ -0,0 +1,82 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+package streamhelper_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/br/pkg/streamhelper"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fullPageScanner always returns exactly `limit` regions, so RegionIter
+// should keep growing PageSize towards MaxPageSize.
+type fullPageScanner struct{}
+
+func (fullPageScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	regions := make([]streamhelper.RegionWithLeader, 0, limit)
+	cur := key
+	for i := 0; i < limit; i++ {
+		next := append(append([]byte{}, cur...), 0)
+		regions = append(regions, streamhelper.RegionWithLeader{
+			Region: &metapb.Region{StartKey: cur, EndKey: next},
+			Leader: &metapb.Peer{Id: 1, StoreId: 1},
+		})
+		cur = next
+	}
+	return regions, nil
+}
+
+func TestRegionIterGrowsPageSizeOnFullPages(t *testing.T) {
+	iter := streamhelper.IterateRegion(fullPageScanner{}, []byte("a"), []byte("z"))
+	initial := iter.PageSize
+
+	_, err := iter.Next(context.Background())
+	require.NoError(t, err)
+	require.Greater(t, iter.PageSize, initial)
+}
+
+func TestRegionIterSeedsPageSizeFromEstimate(t *testing.T) {
+	iter := streamhelper.IterateRegion(fullPageScanner{}, []byte("a"), []byte("z"))
+	iter.EstimateTotalRegions = 256
+
+	_, err := iter.Next(context.Background())
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, iter.PageSize, 256)
+}
+
+// oversizedUntilShrunkScanner rejects any RegionScan whose limit is still
+// above `shrinkBelow` with a gRPC ResourceExhausted error, mimicking PD
+// rejecting an oversized response. It only succeeds once the caller has
+// actually shrunk its page size below that threshold.
+type oversizedUntilShrunkScanner struct {
+	shrinkBelow int
+	attempts    int
+}
+
+func (s *oversizedUntilShrunkScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	s.attempts++
+	if limit >= s.shrinkBelow {
+		return nil, status.Error(codes.ResourceExhausted, "received message larger than max")
+	}
+	return []streamhelper.RegionWithLeader{{
+		Region: &metapb.Region{StartKey: key, EndKey: endKey},
+		Leader: &metapb.Peer{Id: 1, StoreId: 1},
+	}}, nil
+}
+
+func TestRegionIterRetriesWithShrunkPageSizeAfterOversizedResponse(t *testing.T) {
+	scanner := &oversizedUntilShrunkScanner{shrinkBelow: 1024}
+	iter := streamhelper.IterateRegion(scanner, []byte("a"), []byte("z"))
+	require.Greater(t, iter.PageSize, 0)
+	require.GreaterOrEqual(t, iter.PageSize, scanner.shrinkBelow)
+
+	_, err := iter.Next(context.Background())
+	require.NoError(t, err)
+	require.Greater(t, scanner.attempts, 1)
+	require.Less(t, iter.PageSize, scanner.shrinkBelow)
+}
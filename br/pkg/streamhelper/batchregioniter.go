@@ -0,0 +1,186 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+package streamhelper
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pingcap/tidb/br/pkg/utils"
+)
+
+// defaultBatchScanChunkSize bounds how many ranges are submitted to a single
+// BatchRegionScan call. Ranges still in progress are processed in chunks of
+// this size per round rather than all at once, so a caller scanning a huge
+// number of ranges doesn't put one oversized request on the wire.
+const defaultBatchScanChunkSize = 64
+
+// BatchRegionScanner extends RegionScanner with the ability to scan several
+// disjoint key ranges in a single round trip, as introduced by newer PD
+// client versions (BatchScanRegions, see PD client's `pd.Client.BatchScanRegions`).
+// Implementations should return, for each requested range, at most `limit`
+// regions starting from that range's start key, in the same order as
+// `ranges`.
+type BatchRegionScanner interface {
+	BatchRegionScan(ctx context.Context, ranges []KeyRange, limit int) ([][]RegionWithLeader, error)
+}
+
+// RegionBatch is one requested range together with all regions scanned for
+// it so far. KeyRange holds []byte fields and so isn't a valid map key, so
+// IterateRegions returns these in a slice (in the same order as the input
+// ranges) rather than literally a map keyed by range.
+type RegionBatch struct {
+	Range   KeyRange
+	Regions []RegionWithLeader
+}
+
+func (b *RegionBatch) done() bool {
+	if len(b.Regions) == 0 {
+		return false
+	}
+	lastEnd := b.Regions[len(b.Regions)-1].Region.GetEndKey()
+	if len(lastEnd) == 0 {
+		// The last scanned region reaches the end of the whole keyspace.
+		return true
+	}
+	if len(b.Range.EndKey) == 0 {
+		return false
+	}
+	return bytes.Compare(lastEnd, b.Range.EndKey) >= 0
+}
+
+func (b *RegionBatch) currentStartKey() []byte {
+	if len(b.Regions) == 0 {
+		return b.Range.StartKey
+	}
+	return b.Regions[len(b.Regions)-1].Region.GetEndKey()
+}
+
+// CheckBatchRegionConsistency validates that the regions scanned for each
+// requested range are gap-free and fully cover [Range.StartKey,
+// Range.EndKey), exactly like CheckRegionConsistency, but does so
+// independently per range, so the space between two requested ranges is not
+// treated as a gap. It returns the error of the first range that fails the
+// check. It is meant to be called once scanning has finished, not per page:
+// checking against Range.EndKey (rather than the last scanned region's own
+// endKey) is what lets it catch a range that stopped short of its target.
+func CheckBatchRegionConsistency(batches []RegionBatch) error {
+	for _, b := range batches {
+		if err := CheckRegionConsistency(b.Range.StartKey, b.Range.EndKey, b.Regions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IterateRegions scans multiple disjoint key ranges to completion. If `cli`
+// implements BatchRegionScanner, ranges still in progress are submitted to
+// BatchRegionScan in chunks of at most defaultBatchScanChunkSize per round;
+// otherwise the ranges are scanned sequentially, one IterateRegion per
+// range. Either way, each page is verified with CheckRegionConsistency as it
+// is scanned (which also retries leaderless pages, see
+// ErrPDBatchScanRegionNoLeader), and the complete result is verified once
+// more with CheckBatchRegionConsistency before being returned, to catch a
+// range that stopped short of its requested end key.
+func IterateRegions(ctx context.Context, cli RegionScanner, ranges []KeyRange) ([]RegionBatch, error) {
+	var (
+		batches []RegionBatch
+		err     error
+	)
+	if batchCli, ok := cli.(BatchRegionScanner); ok {
+		batches, err = iterateRegionsBatched(ctx, batchCli, ranges)
+	} else {
+		batches, err = iterateRegionsSequential(ctx, cli, ranges)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckBatchRegionConsistency(batches); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+func iterateRegionsSequential(ctx context.Context, cli RegionScanner, ranges []KeyRange) ([]RegionBatch, error) {
+	result := make([]RegionBatch, 0, len(ranges))
+	for _, rng := range ranges {
+		iter := IterateRegion(cli, rng.StartKey, rng.EndKey)
+		batch := RegionBatch{Range: rng}
+		for !iter.Done() {
+			regions, err := iter.Next(ctx)
+			if err != nil {
+				return nil, err
+			}
+			batch.Regions = append(batch.Regions, regions...)
+		}
+		result = append(result, batch)
+	}
+	return result, nil
+}
+
+func iterateRegionsBatched(ctx context.Context, cli BatchRegionScanner, ranges []KeyRange) ([]RegionBatch, error) {
+	batches := make([]RegionBatch, len(ranges))
+	for i, rng := range ranges {
+		batches[i] = RegionBatch{Range: rng}
+	}
+
+	pending := make([]int, len(ranges))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		// next reuses pending's backing array: it never writes past the
+		// index of the element currently being read, so this in-place
+		// filter is safe even though chunks are processed one at a time.
+		next := pending[:0]
+		for start := 0; start < len(pending); start += defaultBatchScanChunkSize {
+			end := start + defaultBatchScanChunkSize
+			if end > len(pending) {
+				end = len(pending)
+			}
+			chunk := pending[start:end]
+
+			state := utils.InitialRetryState(30, 500*time.Millisecond, 500*time.Millisecond)
+			var scanned [][]RegionWithLeader
+			err := utils.WithRetry(ctx, func() error {
+				reqRanges := make([]KeyRange, 0, len(chunk))
+				for _, idx := range chunk {
+					reqRanges = append(reqRanges, KeyRange{
+						StartKey: batches[idx].currentStartKey(),
+						EndKey:   batches[idx].Range.EndKey,
+					})
+				}
+				regionsByRange, err := cli.BatchRegionScan(ctx, reqRanges, defaultPageSize)
+				if err != nil {
+					return err
+				}
+				for i := range chunk {
+					endKey := reqRanges[i].EndKey
+					if len(regionsByRange[i]) > 0 {
+						endKey = regionsByRange[i][len(regionsByRange[i])-1].Region.GetEndKey()
+					}
+					if err := CheckRegionConsistency(reqRanges[i].StartKey, endKey, regionsByRange[i]); err != nil {
+						return err
+					}
+				}
+				scanned = regionsByRange
+				return nil
+			}, &state)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, idx := range chunk {
+				batches[idx].Regions = append(batches[idx].Regions, scanned[i]...)
+				if !batches[idx].done() {
+					next = append(next, idx)
+				}
+			}
+		}
+		pending = next
+	}
+
+	return batches, nil
+}
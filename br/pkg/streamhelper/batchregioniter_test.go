@@ -0,0 +1,104 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+package streamhelper_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/br/pkg/streamhelper"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBatchScanner answers BatchRegionScan by returning one region per
+// requested range, covering it entirely in a single page.
+type fakeBatchScanner struct {
+	calls int
+}
+
+func (s *fakeBatchScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	panic("unused: BatchRegionScanner should be preferred")
+}
+
+func (s *fakeBatchScanner) BatchRegionScan(ctx context.Context, ranges []streamhelper.KeyRange, limit int) ([][]streamhelper.RegionWithLeader, error) {
+	s.calls++
+	out := make([][]streamhelper.RegionWithLeader, len(ranges))
+	for i, rng := range ranges {
+		out[i] = []streamhelper.RegionWithLeader{{
+			Region: &metapb.Region{StartKey: rng.StartKey, EndKey: rng.EndKey},
+			Leader: &metapb.Peer{Id: 1, StoreId: 1},
+		}}
+	}
+	return out, nil
+}
+
+func TestIterateRegionsPrefersBatchScanner(t *testing.T) {
+	cli := &fakeBatchScanner{}
+	ranges := []streamhelper.KeyRange{
+		{StartKey: []byte("a"), EndKey: []byte("b")},
+		{StartKey: []byte("c"), EndKey: []byte("d")},
+	}
+
+	batches, err := streamhelper.IterateRegions(context.Background(), cli, ranges)
+	require.NoError(t, err)
+	require.Equal(t, 1, cli.calls)
+	require.Len(t, batches, 2)
+	require.NoError(t, streamhelper.CheckBatchRegionConsistency(batches))
+	require.Equal(t, ranges[0], batches[0].Range)
+	require.Equal(t, ranges[1], batches[1].Range)
+}
+
+func TestCheckBatchRegionConsistencyDetectsRangeStoppingShort(t *testing.T) {
+	batches := []streamhelper.RegionBatch{{
+		Range: streamhelper.KeyRange{StartKey: []byte("a"), EndKey: []byte("z")},
+		Regions: []streamhelper.RegionWithLeader{{
+			Region: &metapb.Region{StartKey: []byte("a"), EndKey: []byte("m")},
+			Leader: &metapb.Peer{Id: 1, StoreId: 1},
+		}},
+	}}
+	require.Error(t, streamhelper.CheckBatchRegionConsistency(batches))
+}
+
+// chunkSizeRecordingScanner records how many ranges it was asked to scan in
+// each BatchRegionScan call, and completes every range in a single page.
+type chunkSizeRecordingScanner struct {
+	chunkSizes []int
+}
+
+func (s *chunkSizeRecordingScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	panic("unused: BatchRegionScanner should be preferred")
+}
+
+func (s *chunkSizeRecordingScanner) BatchRegionScan(ctx context.Context, ranges []streamhelper.KeyRange, limit int) ([][]streamhelper.RegionWithLeader, error) {
+	s.chunkSizes = append(s.chunkSizes, len(ranges))
+	out := make([][]streamhelper.RegionWithLeader, len(ranges))
+	for i, rng := range ranges {
+		out[i] = []streamhelper.RegionWithLeader{{
+			Region: &metapb.Region{StartKey: rng.StartKey, EndKey: rng.EndKey},
+			Leader: &metapb.Peer{Id: 1, StoreId: 1},
+		}}
+	}
+	return out, nil
+}
+
+func TestIterateRegionsSubmitsRangesInChunks(t *testing.T) {
+	cli := &chunkSizeRecordingScanner{}
+	const numRanges = 150
+	ranges := make([]streamhelper.KeyRange, numRanges)
+	for i := range ranges {
+		ranges[i] = streamhelper.KeyRange{StartKey: []byte{byte(i)}, EndKey: []byte{byte(i + 1)}}
+	}
+
+	batches, err := streamhelper.IterateRegions(context.Background(), cli, ranges)
+	require.NoError(t, err)
+	require.Len(t, batches, numRanges)
+
+	total := 0
+	for _, size := range cli.chunkSizes {
+		require.LessOrEqual(t, size, 64)
+		total += size
+	}
+	require.Equal(t, numRanges, total)
+	require.Greater(t, len(cli.chunkSizes), 1)
+}
@@ -0,0 +1,158 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+package streamhelper_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/br/pkg/streamhelper"
+	"github.com/stretchr/testify/require"
+)
+
+// uintKeyScanner serves RegionScan over a keyspace of 8-byte big-endian
+// integer keys [0, keyCount), one region per integer, so ordering across
+// shards is easy to assert on regardless of how splitKeyRange pads keys.
+type uintKeyScanner struct {
+	keyCount uint64
+}
+
+func uintKey(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+
+func (s uintKeyScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	start := uint64(0)
+	if len(key) > 0 {
+		start = binary.BigEndian.Uint64(key)
+	}
+	if start >= s.keyCount {
+		// The last region has no end key, so it contains every key past it.
+		start = s.keyCount - 1
+	}
+	end := s.keyCount
+	hasEnd := len(endKey) > 0
+	if hasEnd {
+		end = binary.BigEndian.Uint64(endKey)
+	}
+
+	var regions []streamhelper.RegionWithLeader
+	for v := start; v < end && v < s.keyCount; v++ {
+		regionEnd := uintKey(v + 1)
+		if v == s.keyCount-1 {
+			regionEnd = nil
+		}
+		regions = append(regions, streamhelper.RegionWithLeader{
+			Region: &metapb.Region{StartKey: uintKey(v), EndKey: regionEnd},
+			Leader: &metapb.Peer{Id: 1, StoreId: 1},
+		})
+		if len(regions) >= limit {
+			break
+		}
+	}
+	return regions, nil
+}
+
+func TestIterateRegionParallelMergesInKeyOrder(t *testing.T) {
+	scanner := uintKeyScanner{keyCount: 200}
+	out, errCh := streamhelper.IterateRegionParallel(context.Background(), scanner, uintKey(0), uintKey(200), 4)
+
+	var keys [][]byte
+	for region := range out {
+		keys = append(keys, region.Region.StartKey)
+	}
+	require.NoError(t, <-errCh)
+	require.Len(t, keys, 200)
+	for i := 1; i < len(keys); i++ {
+		require.Less(t, bytes.Compare(keys[i-1], keys[i]), 0)
+	}
+}
+
+// wideRegionScanner serves RegionScan over a keyspace of 8-byte big-endian
+// integer keys [0, keyCount), grouped into regions of regionWidth integers
+// each, aligned to multiples of regionWidth rather than to whatever key a
+// caller happens to scan from. This mimics real PD behaviour: a region
+// straddling a splitKeyRange split point is returned as the last region of
+// the shard below the split and again as the first region of the shard
+// above it, since RegionScan starts from the region that contains the query
+// key.
+type wideRegionScanner struct {
+	keyCount    uint64
+	regionWidth uint64
+}
+
+func (s wideRegionScanner) alignDown(v uint64) uint64 {
+	return (v / s.regionWidth) * s.regionWidth
+}
+
+func (s wideRegionScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	start := uint64(0)
+	if len(key) > 0 {
+		start = binary.BigEndian.Uint64(key)
+	}
+	start = s.alignDown(start)
+	end := s.keyCount
+	if len(endKey) > 0 {
+		end = binary.BigEndian.Uint64(endKey)
+	}
+
+	var regions []streamhelper.RegionWithLeader
+	for v := start; v < end && v < s.keyCount; v += s.regionWidth {
+		regionEnd := v + s.regionWidth
+		var endBytes []byte
+		if regionEnd < s.keyCount {
+			endBytes = uintKey(regionEnd)
+		}
+		regions = append(regions, streamhelper.RegionWithLeader{
+			Region: &metapb.Region{StartKey: uintKey(v), EndKey: endBytes},
+			Leader: &metapb.Peer{Id: 1, StoreId: 1},
+		})
+		if len(regions) >= limit || regionEnd >= s.keyCount {
+			break
+		}
+	}
+	return regions, nil
+}
+
+func TestIterateRegionParallelDropsOverlapAtShardBoundary(t *testing.T) {
+	// regionWidth (7) doesn't evenly divide the shard split points that
+	// splitKeyRange picks for a 200-wide range over 4 workers, so at least
+	// one region is guaranteed to straddle a split point.
+	scanner := wideRegionScanner{keyCount: 200, regionWidth: 7}
+	out, errCh := streamhelper.IterateRegionParallel(context.Background(), scanner, uintKey(0), uintKey(200), 4)
+
+	var regions []*metapb.Region
+	for region := range out {
+		regions = append(regions, region.Region)
+	}
+	require.NoError(t, <-errCh)
+	require.NotEmpty(t, regions)
+
+	require.Equal(t, uint64(0), binary.BigEndian.Uint64(regions[0].StartKey))
+	for i := 1; i < len(regions); i++ {
+		prevEnd := regions[i-1].EndKey
+		curStart := regions[i].StartKey
+		require.Truef(t, bytes.Equal(prevEnd, curStart),
+			"region %d ends at %x but region %d starts at %x: gap or duplicate/overlap", i-1, prevEnd, i, curStart)
+	}
+}
+
+func TestIterateRegionParallelHandlesUnboundedEndKey(t *testing.T) {
+	scanner := uintKeyScanner{keyCount: 256}
+	out, errCh := streamhelper.IterateRegionParallel(context.Background(), scanner, uintKey(0), nil, 4)
+
+	var keys [][]byte
+	for region := range out {
+		keys = append(keys, region.Region.StartKey)
+	}
+	require.NoError(t, <-errCh)
+	require.Len(t, keys, 256)
+	for i := 1; i < len(keys); i++ {
+		require.Less(t, bytes.Compare(keys[i-1], keys[i]), 0)
+	}
+}
@@ -5,17 +5,25 @@ package streamhelper
 import (
 	"bytes"
 	"context"
+	"math/big"
+	"sync"
 	"time"
 
-	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/metapb"
-	berrors "github.com/pingcap/tidb/br/pkg/errors"
-	"github.com/pingcap/tidb/br/pkg/redact"
 	"github.com/pingcap/tidb/br/pkg/utils"
+	"github.com/pingcap/tidb/br/pkg/utils/regionscan"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	defaultPageSize = 2048
+
+	// defaultMinPageSize and defaultMaxPageSize bound how far the adaptive
+	// PageSize is allowed to shrink or grow, mirroring PD's own patrol scan
+	// limit (which ranges from 128 to 8192, scaled by region count).
+	defaultMinPageSize = 128
+	defaultMaxPageSize = 8192
 )
 
 type RegionWithLeader struct {
@@ -23,6 +31,13 @@ type RegionWithLeader struct {
 	Leader *metapb.Peer
 }
 
+// GetStartKey, GetEndKey and HasLeader implement regionscan.RegionLike, so
+// RegionWithLeader can be fed directly into the shared consistency check and
+// retry loop in br/pkg/utils/regionscan.
+func (r RegionWithLeader) GetStartKey() []byte { return r.Region.GetStartKey() }
+func (r RegionWithLeader) GetEndKey() []byte   { return r.Region.GetEndKey() }
+func (r RegionWithLeader) HasLeader() bool     { return r.Leader != nil }
+
 type RegionScanner interface {
 	// RegionScan gets a list of regions, starts from the region that contains key.
 	// Limit limits the maximum number of regions returned.
@@ -30,93 +45,340 @@ type RegionScanner interface {
 }
 
 type RegionIter struct {
-	cli              RegionScanner
-	startKey, endKey []byte
-	currentStartKey  []byte
-	// When the endKey become "", we cannot check whether the scan is done by
-	// comparing currentStartKey and endKey (because "" has different meaning in start key and end key).
-	// So set this to `ture` when endKey == "" and the scan is done.
-	infScanFinished bool
+	cli  RegionScanner
+	core *regionscan.Iterator[RegionWithLeader]
 
 	// The max slice size returned by `Next`.
-	// This can be changed before calling `Next` each time,
-	// however no thread safety provided.
+	// This is now adapted automatically between MinPageSize and MaxPageSize
+	// based on how PD responds (see Next); it can still be set directly
+	// before calling `Next` to seed a different starting point, however no
+	// thread safety is provided.
 	PageSize int
+
+	// MinPageSize and MaxPageSize bound the values PageSize can adapt to.
+	// They default to defaultMinPageSize and defaultMaxPageSize.
+	MinPageSize int
+	MaxPageSize int
+
+	// EstimateTotalRegions, when positive, seeds PageSize (clamped to
+	// [MinPageSize, MaxPageSize]) instead of defaultPageSize, letting
+	// a caller that knows roughly how many regions it will scan (e.g. BR
+	// restore knows the size of the range being restored) start at a
+	// sensible page size rather than ramping up from scratch.
+	EstimateTotalRegions int
+	pageSizeSeeded       bool
 }
 
 // IterateRegion creates an iterater over the region range.
 func IterateRegion(cli RegionScanner, startKey, endKey []byte) *RegionIter {
-	return &RegionIter{
-		cli:             cli,
-		startKey:        startKey,
-		endKey:          endKey,
-		currentStartKey: startKey,
-		PageSize:        defaultPageSize,
+	r := &RegionIter{
+		cli:         cli,
+		PageSize:    defaultPageSize,
+		MinPageSize: defaultMinPageSize,
+		MaxPageSize: defaultMaxPageSize,
 	}
+	retry := func(ctx context.Context, exec func() error) error {
+		state := utils.InitialRetryState(30, 500*time.Millisecond, 500*time.Millisecond)
+		return utils.WithRetry(ctx, exec, &state)
+	}
+	r.core = regionscan.NewIterator(r.scanPage, retry, startKey, endKey)
+	return r
 }
 
-func CheckRegionConsistency(startKey, endKey []byte, regions []RegionWithLeader) error {
-	// current pd can't guarantee the consistency of returned regions
-	if len(regions) == 0 {
-		return errors.Annotatef(berrors.ErrPDBatchScanRegion, "scan region return empty result, startKey: %s, endKey: %s",
-			redact.Key(startKey), redact.Key(endKey))
+// scanPage is the regionscan.ScanFunc backing core: it calls the underlying
+// RegionScanner and folds the result into the adaptive PageSize heuristics
+// (see growPageSize/shrinkPageSize), then hands the page to core for
+// consistency checking.
+func (r *RegionIter) scanPage(ctx context.Context, startKey, endKey []byte, limit int) ([]RegionWithLeader, error) {
+	regions, err := r.cli.RegionScan(ctx, startKey, endKey, limit)
+	if err != nil {
+		if isOversizedResponseError(err) {
+			r.shrinkPageSize()
+		}
+		return nil, err
 	}
-
-	if bytes.Compare(regions[0].Region.StartKey, startKey) > 0 {
-		return errors.Annotatef(berrors.ErrPDBatchScanRegion, "first region's startKey > startKey, startKey: %s, regionStartKey: %s",
-			redact.Key(startKey), redact.Key(regions[0].Region.StartKey))
-	} else if len(regions[len(regions)-1].Region.EndKey) != 0 && bytes.Compare(regions[len(regions)-1].Region.EndKey, endKey) < 0 {
-		return errors.Annotatef(berrors.ErrPDBatchScanRegion, "last region's endKey < endKey, endKey: %s, regionEndKey: %s",
-			redact.Key(endKey), redact.Key(regions[len(regions)-1].Region.EndKey))
+	if len(regions) < limit {
+		r.shrinkPageSize()
+	} else {
+		r.growPageSize()
 	}
+	return regions, nil
+}
 
-	cur := regions[0]
-	for _, r := range regions[1:] {
-		if !bytes.Equal(cur.Region.EndKey, r.Region.StartKey) {
-			return errors.Annotatef(berrors.ErrPDBatchScanRegion, "region endKey not equal to next region startKey, endKey: %s, startKey: %s",
-				redact.Key(cur.Region.EndKey), redact.Key(r.Region.StartKey))
-		}
-		cur = r
+func clampPageSize(size, min, max int) int {
+	if size < min {
+		return min
 	}
+	if size > max {
+		return max
+	}
+	return size
+}
+
+// growPageSize doubles PageSize, capped at MaxPageSize. It is called after a
+// full page is returned without error, since that suggests PD can serve a
+// larger page without hitting the message-size cliff.
+func (r *RegionIter) growPageSize() {
+	r.PageSize = clampPageSize(r.PageSize*2, r.MinPageSize, r.MaxPageSize)
+}
 
-	return nil
+// shrinkPageSize halves PageSize, floored at MinPageSize. It is called when
+// PD returns fewer regions than requested, or an oversized-response error,
+// either of which signal that the current page size is putting PD under
+// pressure.
+func (r *RegionIter) shrinkPageSize() {
+	r.PageSize = clampPageSize(r.PageSize/2, r.MinPageSize, r.MaxPageSize)
+}
+
+// isOversizedResponseError reports whether err looks like the gRPC
+// "received message larger than max" failure that MaxCallRecvMsgSize guards
+// against.
+func isOversizedResponseError(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// ErrPDBatchScanRegionNoLeader is returned when a scanned page contains a
+// region with no leader. This happens when PD serves regions that it has just
+// loaded from local disk before their leaders have reported a heartbeat; the
+// regions themselves are consistent, but any RPC sent to them would fail, so
+// the scan should simply be retried. It is the same sentinel as
+// regionscan.ErrNoLeader, kept under this name for existing callers.
+var ErrPDBatchScanRegionNoLeader = regionscan.ErrNoLeader
+
+// CheckRegionConsistency validates that `regions` are gap-free, cover
+// [startKey, endKey), and all have a leader. It wraps the shared
+// implementation in br/pkg/utils/regionscan so this check stays identical to
+// the one used by other region-scan callers.
+func CheckRegionConsistency(startKey, endKey []byte, regions []RegionWithLeader) error {
+	return regionscan.CheckConsistency(startKey, endKey, regions)
+}
+
+// seedPageSize sets the initial PageSize from EstimateTotalRegions the first
+// time Next is called. A positive EstimateTotalRegions replaces any PageSize
+// set before that first call.
+func (r *RegionIter) seedPageSize() {
+	if r.pageSizeSeeded {
+		return
+	}
+	r.pageSizeSeeded = true
+	if r.EstimateTotalRegions > 0 {
+		r.PageSize = clampPageSize(r.EstimateTotalRegions, r.MinPageSize, r.MaxPageSize)
+	}
 }
 
 // Next get the next page of regions.
 func (r *RegionIter) Next(ctx context.Context) ([]RegionWithLeader, error) {
-	var rs []RegionWithLeader
-	state := utils.InitialRetryState(30, 500*time.Millisecond, 500*time.Millisecond)
-	err := utils.WithRetry(ctx, func() error {
-		regions, err := r.cli.RegionScan(ctx, r.currentStartKey, r.endKey, r.PageSize)
-		if err != nil {
-			return err
+	r.seedPageSize()
+	// r.PageSize is re-read on every retry attempt (see Iterator.Next), so a
+	// shrink from scanPage on an oversized-response error actually takes
+	// effect on the retry instead of repeating the same too-large request.
+	return r.core.Next(ctx, func() int { return r.PageSize })
+}
+
+// Done checks whether the iteration is done.
+func (r *RegionIter) Done() bool {
+	return r.core.Done()
+}
+
+// KeyRange is a half-open key range [StartKey, EndKey). An empty EndKey means
+// "no upper bound".
+type KeyRange struct {
+	StartKey []byte
+	EndKey   []byte
+}
+
+// virtualInfinityWidth is the key width (in bytes) used to synthesize a
+// virtual upper bound when splitting an unbounded (endKey == "") range. We
+// have no way to know the real maximum key, so this is only a heuristic for
+// choosing split points; see splitKeyRange.
+const virtualInfinityWidth = 8
+
+// splitKeyRange splits [startKey, endKey) into at most `n` consecutive,
+// non-overlapping sub-ranges of roughly equal size, in increasing key order.
+// Keys are arbitrary byte strings rather than fixed-width integers, so the
+// split points are computed by padding the shorter key with trailing zero
+// bytes and treating the result as a big-endian integer; this is precise
+// enough for sharding a scan and does not need to align with any particular
+// key encoding.
+//
+// An unbounded endKey is handled by splitting against a virtual upper bound
+// (all 0xFF bytes, at least virtualInfinityWidth bytes wide) instead of
+// giving up on splitting altogether; the last returned range's EndKey is
+// still the true "" unbounded value, so a keyspace larger than the virtual
+// bound still scans correctly, just with the tail shard doing more than its
+// even share of the work.
+//
+// n <= 1 yields the original range unsplit.
+func splitKeyRange(startKey, endKey []byte, n int) []KeyRange {
+	if n <= 1 {
+		return []KeyRange{{StartKey: startKey, EndKey: endKey}}
+	}
+
+	unbounded := len(endKey) == 0
+	virtualEndKey := endKey
+	if unbounded {
+		width := len(startKey)
+		if width < virtualInfinityWidth {
+			width = virtualInfinityWidth
+		}
+		virtualEndKey = bytes.Repeat([]byte{0xFF}, width)
+	}
+
+	width := len(startKey)
+	if len(virtualEndKey) > width {
+		width = len(virtualEndKey)
+	}
+	pad := func(k []byte) *big.Int {
+		buf := make([]byte, width)
+		copy(buf, k)
+		return new(big.Int).SetBytes(buf)
+	}
+	start, end := pad(startKey), pad(virtualEndKey)
+	span := new(big.Int).Sub(end, start)
+	step := new(big.Int).Div(span, big.NewInt(int64(n)))
+	if step.Sign() <= 0 {
+		return []KeyRange{{StartKey: startKey, EndKey: endKey}}
+	}
+
+	ranges := make([]KeyRange, 0, n)
+	cur := start
+	buf := make([]byte, width)
+	for i := 0; i < n; i++ {
+		curKey := startKey
+		if i > 0 {
+			cur.FillBytes(buf)
+			curKey = append([]byte(nil), buf...)
 		}
-		if len(regions) > 0 {
-			endKey := regions[len(regions)-1].Region.GetEndKey()
-			if err := CheckRegionConsistency(r.currentStartKey, endKey, regions); err != nil {
-				return err
+
+		next := end
+		if i != n-1 {
+			next = new(big.Int).Add(cur, step)
+			if next.Cmp(end) >= 0 {
+				next = end
 			}
-			rs = regions
-			return nil
 		}
-		return CheckRegionConsistency(r.currentStartKey, r.endKey, regions)
-	}, &state)
-	if err != nil {
-		return nil, err
+		nextKey := virtualEndKey
+		if next.Cmp(end) != 0 {
+			next.FillBytes(buf)
+			nextKey = append([]byte(nil), buf...)
+		}
+
+		ranges = append(ranges, KeyRange{StartKey: curKey, EndKey: nextKey})
+		if next.Cmp(end) >= 0 {
+			break
+		}
+		cur = next
 	}
-	endKey := rs[len(rs)-1].Region.EndKey
-	// We have meet the last region.
-	if len(endKey) == 0 {
-		r.infScanFinished = true
+
+	if unbounded {
+		// Restore the true unbounded end for the last shard: the virtual
+		// bound above only exists to compute split points.
+		ranges[len(ranges)-1].EndKey = nil
 	}
-	r.currentStartKey = endKey
-	return rs, nil
+	return ranges
 }
 
-// Done checks whether the iteration is done.
-func (r *RegionIter) Done() bool {
-	if len(r.endKey) == 0 {
-		return r.infScanFinished
+// IterateRegionParallel scans [startKey, endKey) the same way RegionIter
+// does, but shards the range into `workers` sub-ranges and scans them
+// concurrently with bounded concurrency. This is meant for wide scans (e.g.
+// advancing the log-backup checkpoint across a huge keyspace) where a single
+// paginated scan becomes the bottleneck.
+//
+// Each shard keeps the same consistency guarantee as RegionIter.Next: before
+// a page is delivered, it is verified with CheckRegionConsistency. The
+// shards produced by splitKeyRange have split points that are arbitrary byte
+// keys, not real region boundaries, so a region can straddle a split point
+// and overlap both of its neighbouring shards' ranges (PD's RegionScan
+// returns every region that overlaps the requested range, including a
+// partially-overlapping one at either end); each shard drops that region
+// from the start of its own scan rather than the previous shard's end, so it
+// is still emitted exactly once. With that dedup in place, the merged stream
+// is filled by draining each shard's regions, one shard at a time, in
+// increasing range order: the scanning itself still happens in the
+// background across all shards concurrently, only the emission is
+// sequenced, giving callers a single globally key-ordered, gap-free,
+// non-overlapping stream without needing to buffer and sort everything
+// themselves.
+//
+// As soon as any shard fails, its error is sent to the returned error
+// channel, the context used by the remaining shards is cancelled, and the
+// region channel is drained and closed. Only the first error is reported.
+func IterateRegionParallel(ctx context.Context, cli RegionScanner, startKey, endKey []byte, workers int) (<-chan RegionWithLeader, <-chan error) {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	ranges := splitKeyRange(startKey, endKey, workers)
+	shardChans := make([]chan RegionWithLeader, len(ranges))
+
+	out := make(chan RegionWithLeader, workers)
+	errCh := make(chan error, 1)
+	shardCtx, cancel := context.WithCancel(ctx)
+
+	var reportOnce sync.Once
+	reportErr := func(err error) {
+		reportOnce.Do(func() {
+			errCh <- err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(ranges))
+	for i, rng := range ranges {
+		shardChans[i] = make(chan RegionWithLeader, defaultPageSize)
+		i, rng := i, rng
+		go func() {
+			defer wg.Done()
+			defer close(shardChans[i])
+			iter := IterateRegion(cli, rng.StartKey, rng.EndKey)
+			first := true
+			for !iter.Done() {
+				regions, err := iter.Next(shardCtx)
+				if err != nil {
+					reportErr(err)
+					return
+				}
+				if first {
+					first = false
+					// A region straddling this shard's StartKey overlaps
+					// [StartKey, EndKey) too, so PD returns it as the last
+					// region of the previous shard's scan *and* again here,
+					// since RegionScan starts from the region containing the
+					// query key. Drop it to avoid emitting it twice; it can
+					// only ever be the first region of the first page, since
+					// every later page starts from a key this shard has
+					// already advanced past.
+					if i > 0 && len(regions) > 0 && bytes.Compare(regions[0].Region.GetStartKey(), rng.StartKey) < 0 {
+						regions = regions[1:]
+					}
+				}
+				for _, region := range regions {
+					select {
+					case shardChans[i] <- region:
+					case <-shardCtx.Done():
+						return
+					}
+				}
+			}
+		}()
 	}
-	return bytes.Compare(r.currentStartKey, r.endKey) >= 0
+
+	// Merge shard outputs in range order. Each shard's channel is closed
+	// (whether it finished normally or was cut short by reportErr cancelling
+	// shardCtx) once its goroutine returns, so ranging over it always
+	// terminates.
+	go func() {
+		defer cancel()
+		for _, ch := range shardChans {
+			for region := range ch {
+				out <- region
+			}
+		}
+		wg.Wait()
+		close(out)
+		close(errCh)
+	}()
+
+	return out, errCh
 }
@@ -0,0 +1,49 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+package streamhelper_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/br/pkg/streamhelper"
+	"github.com/stretchr/testify/require"
+)
+
+// noLeaderThenHealthyScanner returns regions without a leader for the first
+// `failures` calls to RegionScan, then returns a single healthy region
+// covering the whole requested range.
+type noLeaderThenHealthyScanner struct {
+	failures int
+	calls    int
+}
+
+func (s *noLeaderThenHealthyScanner) RegionScan(ctx context.Context, key, endKey []byte, limit int) ([]streamhelper.RegionWithLeader, error) {
+	s.calls++
+	region := &metapb.Region{StartKey: key, EndKey: endKey}
+	if s.calls <= s.failures {
+		return []streamhelper.RegionWithLeader{{Region: region, Leader: nil}}, nil
+	}
+	return []streamhelper.RegionWithLeader{{Region: region, Leader: &metapb.Peer{Id: 1, StoreId: 1}}}, nil
+}
+
+func TestRegionIterRetriesOnNoLeader(t *testing.T) {
+	scanner := &noLeaderThenHealthyScanner{failures: 3}
+	iter := streamhelper.IterateRegion(scanner, []byte("a"), []byte("z"))
+
+	regions, err := iter.Next(context.Background())
+	require.NoError(t, err)
+	require.Len(t, regions, 1)
+	require.NotNil(t, regions[0].Leader)
+	require.Equal(t, scanner.failures+1, scanner.calls)
+}
+
+func TestCheckRegionConsistencyDetectsNoLeader(t *testing.T) {
+	regions := []streamhelper.RegionWithLeader{
+		{Region: &metapb.Region{StartKey: []byte("a"), EndKey: []byte("z")}, Leader: nil},
+	}
+	err := streamhelper.CheckRegionConsistency([]byte("a"), []byte("z"), regions)
+	require.Error(t, err)
+	require.True(t, streamhelper.ErrPDBatchScanRegionNoLeader.Equal(err))
+}
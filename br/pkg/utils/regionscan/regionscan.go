@@ -0,0 +1,163 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+// Package regionscan holds the region-scan consistency check and paginated
+// retry loop used by br/pkg/streamhelper (log backup checkpoint
+// advancement) via RegionLike/CheckConsistency/Iterator below. Bug fixes
+// made here, such as retrying on leaderless pages, apply uniformly to every
+// caller that adopts this package.
+//
+// br/pkg/restore/split (BR restore's PaginateScanRegion) carries a
+// near-identical copy of this logic under a different region type
+// (RegionInfo) and different retry tunables (SplitRetryTimes,
+// ScanRegionAttemptTimes, ScanRegionPaginationLimit); unifying it onto
+// RegionLike/Iterator here was the other half of the intended cleanup, but
+// br/pkg/restore/split is not part of this checkout, so that half has not
+// been done and the duplication between the two implementations still
+// exists. Migrating split.PaginateScanRegion onto this package is real,
+// outstanding work, not something landing this package already achieves.
+package regionscan
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pingcap/errors"
+	berrors "github.com/pingcap/tidb/br/pkg/errors"
+	"github.com/pingcap/tidb/br/pkg/redact"
+)
+
+// RegionLike is the minimal view over a scanned region that CheckConsistency
+// and Iterator need. Callers implement it on whatever concrete region type
+// their PD client returns (e.g. streamhelper.RegionWithLeader).
+type RegionLike interface {
+	GetStartKey() []byte
+	GetEndKey() []byte
+	HasLeader() bool
+}
+
+// ErrNoLeader is returned by CheckConsistency when a scanned page contains a
+// region with no leader. This happens when PD serves regions it has just
+// loaded from local disk before their leaders have reported a heartbeat; the
+// regions themselves are consistent, but any RPC sent to them would fail, so
+// the scan should simply be retried rather than treated as done.
+var ErrNoLeader = errors.Normalize(
+	"scan region returned region(s) without a leader, startKey: %s, endKey: %s",
+	errors.RFCCodeText("BR:PD:ErrRegionScanNoLeader"),
+)
+
+// CheckConsistency validates that `regions` are gap-free and cover
+// [startKey, endKey), and that every region has a leader.
+func CheckConsistency[R RegionLike](startKey, endKey []byte, regions []R) error {
+	// current pd can't guarantee the consistency of returned regions
+	if len(regions) == 0 {
+		return errors.Annotatef(berrors.ErrPDBatchScanRegion, "scan region return empty result, startKey: %s, endKey: %s",
+			redact.Key(startKey), redact.Key(endKey))
+	}
+
+	if bytes.Compare(regions[0].GetStartKey(), startKey) > 0 {
+		return errors.Annotatef(berrors.ErrPDBatchScanRegion, "first region's startKey > startKey, startKey: %s, regionStartKey: %s",
+			redact.Key(startKey), redact.Key(regions[0].GetStartKey()))
+	} else if len(regions[len(regions)-1].GetEndKey()) != 0 && bytes.Compare(regions[len(regions)-1].GetEndKey(), endKey) < 0 {
+		return errors.Annotatef(berrors.ErrPDBatchScanRegion, "last region's endKey < endKey, endKey: %s, regionEndKey: %s",
+			redact.Key(endKey), redact.Key(regions[len(regions)-1].GetEndKey()))
+	}
+
+	cur := regions[0]
+	if !cur.HasLeader() {
+		return errors.Annotatef(ErrNoLeader, "startKey: %s, endKey: %s", redact.Key(startKey), redact.Key(endKey))
+	}
+	for _, r := range regions[1:] {
+		if !bytes.Equal(cur.GetEndKey(), r.GetStartKey()) {
+			return errors.Annotatef(berrors.ErrPDBatchScanRegion, "region endKey not equal to next region startKey, endKey: %s, startKey: %s",
+				redact.Key(cur.GetEndKey()), redact.Key(r.GetStartKey()))
+		}
+		if !r.HasLeader() {
+			return errors.Annotatef(ErrNoLeader, "startKey: %s, endKey: %s", redact.Key(startKey), redact.Key(endKey))
+		}
+		cur = r
+	}
+
+	return nil
+}
+
+// ScanFunc fetches up to `limit` regions starting at startKey, mirroring
+// streamhelper.RegionScanner.RegionScan / the PD scan call used by BR
+// restore's split package.
+type ScanFunc[R RegionLike] func(ctx context.Context, startKey, endKey []byte, limit int) ([]R, error)
+
+// RetryPolicy runs `exec`, retrying on error according to whatever backoff
+// the caller configures, and returns the last error if all attempts fail.
+// This is intentionally a plain function type rather than an interface
+// tied to utils.RetryState, so callers with different retry tunables
+// (streamhelper's fixed backoff vs split's SplitRetryTimes /
+// ScanRegionAttemptTimes) can plug in their own policy without
+// regionscan needing to know about either.
+type RetryPolicy func(ctx context.Context, exec func() error) error
+
+// Iterator paginates a ScanFunc over [StartKey, EndKey), verifying every
+// page with CheckConsistency and retrying with Retry until a good page is
+// returned. It carries no notion of page size itself: callers pass the
+// desired limit into Next each time, so they remain free to adapt it
+// between calls.
+type Iterator[R RegionLike] struct {
+	scan  ScanFunc[R]
+	retry RetryPolicy
+
+	endKey  []byte
+	current []byte
+	done    bool
+}
+
+// NewIterator creates an Iterator over [startKey, endKey).
+func NewIterator[R RegionLike](scan ScanFunc[R], retry RetryPolicy, startKey, endKey []byte) *Iterator[R] {
+	return &Iterator[R]{
+		scan:    scan,
+		retry:   retry,
+		endKey:  endKey,
+		current: startKey,
+	}
+}
+
+// Done checks whether the iteration is done.
+func (it *Iterator[R]) Done() bool {
+	if it.done {
+		return true
+	}
+	if len(it.endKey) == 0 {
+		return false
+	}
+	return bytes.Compare(it.current, it.endKey) >= 0
+}
+
+// Next gets the next page of regions. getLimit is called fresh on every
+// retry attempt, not just once: a ScanFunc that shrinks its caller's page
+// size in response to an error (e.g. an oversized-response error) needs the
+// smaller size to actually be used on the next attempt, or the retry loop
+// would keep hammering PD at the same size that just failed.
+func (it *Iterator[R]) Next(ctx context.Context, getLimit func() int) ([]R, error) {
+	var rs []R
+	err := it.retry(ctx, func() error {
+		regions, err := it.scan(ctx, it.current, it.endKey, getLimit())
+		if err != nil {
+			return err
+		}
+		if len(regions) > 0 {
+			endKey := regions[len(regions)-1].GetEndKey()
+			if err := CheckConsistency(it.current, endKey, regions); err != nil {
+				return err
+			}
+			rs = regions
+			return nil
+		}
+		return CheckConsistency(it.current, it.endKey, regions)
+	})
+	if err != nil {
+		return nil, err
+	}
+	endKey := rs[len(rs)-1].GetEndKey()
+	if len(endKey) == 0 {
+		it.done = true
+	}
+	it.current = endKey
+	return rs, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 PingCAP, Inc. Licensed under Apache-2.0.
+
+package regionscan_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/tidb/br/pkg/utils/regionscan"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRegion struct {
+	start, end []byte
+	hasLeader  bool
+}
+
+func (r fakeRegion) GetStartKey() []byte { return r.start }
+func (r fakeRegion) GetEndKey() []byte   { return r.end }
+func (r fakeRegion) HasLeader() bool     { return r.hasLeader }
+
+func TestCheckConsistencyDetectsGap(t *testing.T) {
+	regions := []fakeRegion{
+		{start: []byte("a"), end: []byte("b"), hasLeader: true},
+		{start: []byte("c"), end: []byte("d"), hasLeader: true},
+	}
+	err := regionscan.CheckConsistency([]byte("a"), []byte("d"), regions)
+	require.Error(t, err)
+}
+
+func TestCheckConsistencyDetectsNoLeader(t *testing.T) {
+	regions := []fakeRegion{{start: []byte("a"), end: []byte("z"), hasLeader: false}}
+	err := regionscan.CheckConsistency([]byte("a"), []byte("z"), regions)
+	require.Error(t, err)
+	require.True(t, regionscan.ErrNoLeader.Equal(err))
+}
+
+func TestIteratorPaginatesToCompletion(t *testing.T) {
+	pages := [][]fakeRegion{
+		{{start: []byte("a"), end: []byte("m"), hasLeader: true}},
+		{{start: []byte("m"), end: []byte(""), hasLeader: true}},
+	}
+	calls := 0
+	scan := func(ctx context.Context, startKey, endKey []byte, limit int) ([]fakeRegion, error) {
+		page := pages[calls]
+		calls++
+		return page, nil
+	}
+	retry := func(ctx context.Context, exec func() error) error { return exec() }
+
+	it := regionscan.NewIterator[fakeRegion](scan, retry, []byte("a"), []byte(""))
+	var seen []fakeRegion
+	for !it.Done() {
+		regions, err := it.Next(context.Background(), func() int { return 10 })
+		require.NoError(t, err)
+		seen = append(seen, regions...)
+	}
+	require.Len(t, seen, 2)
+	require.Equal(t, 2, calls)
+}